@@ -0,0 +1,954 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"gopkg.in/ini.v1"
+)
+
+func TestMain(m *testing.M) {
+	// 被测函数通过 info/warnLog/errorLog 输出日志，测试时丢弃，只看断言结果
+	logger.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// fakeDB 是测试用的 database/sql 连接器，不连接真实数据库：查询和执行交给 query/exec 回调，
+// 回调的 conn 参数为连接序号（从 1 开始，每次新建连接加 1），用于模拟重建连接后的不同行为。
+type fakeDB struct {
+	mu    sync.Mutex
+	conns int
+	query func(conn int, query string, args []driver.NamedValue) (*fakeRows, error)
+	exec  func(conn int, query string, args []driver.NamedValue) error
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.conns++
+	return &fakeConn{db: f, id: f.conns}, nil
+}
+
+func (f *fakeDB) Driver() driver.Driver { return fakeDriver{} }
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(string) (driver.Conn, error) {
+	return nil, errors.New("fakeDriver: 只能通过 sql.OpenDB 使用")
+}
+
+type fakeConn struct {
+	db *fakeDB
+	id int
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("fakeConn: 不支持 Prepare")
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("fakeConn: 不支持事务")
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if c.db.query == nil {
+		return nil, errors.New("fakeConn: 未预设查询结果")
+	}
+	rows, err := c.db.query(c.id, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if c.db.exec != nil {
+		if err := c.db.exec(c.id, query, args); err != nil {
+			return nil, err
+		}
+	}
+	return driver.RowsAffected(0), nil
+}
+
+// fakeRows 是预设的查询结果。
+type fakeRows struct {
+	cols []string
+	rows [][]driver.Value
+	pos  int
+}
+
+func (r *fakeRows) Columns() []string { return r.cols }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.pos])
+	r.pos++
+	return nil
+}
+
+// newFakePool 用 fakeDB 创建连接池，测试结束时关闭。
+func newFakePool(t *testing.T, f *fakeDB, snapshotTS *string) *snapshotConnPool {
+	t.Helper()
+	db := sql.OpenDB(f)
+	pool := newSnapshotConnPool(db, snapshotTS, nil, false, 4, time.Second)
+	t.Cleanup(func() {
+		pool.close()
+		db.Close()
+	})
+	return pool
+}
+
+// schemataQuery 按 SCHEMA_NAME LIKE ? 在 names 中模拟 INFORMATION_SCHEMA.SCHEMATA 查询。
+func schemataQuery(names []string) func(int, string, []driver.NamedValue) (*fakeRows, error) {
+	return func(_ int, query string, args []driver.NamedValue) (*fakeRows, error) {
+		if !strings.Contains(query, "INFORMATION_SCHEMA.SCHEMATA") || len(args) != 1 {
+			return nil, errors.New("unexpected query: " + query)
+		}
+		like := regexp.QuoteMeta(args[0].Value.(string))
+		like = strings.NewReplacer("%", ".*", "_", ".").Replace(like)
+		re := regexp.MustCompile("^" + like + "$")
+		rows := &fakeRows{cols: []string{"db_name"}}
+		for _, name := range names {
+			if re.MatchString(name) {
+				rows.rows = append(rows.rows, []driver.Value{name})
+			}
+		}
+		return rows, nil
+	}
+}
+
+func TestDBIgnoreFilter(t *testing.T) {
+	dbs := []string{"app_1", "app_2", "scratch", "test", "test_tmp"}
+	tests := []struct {
+		name        string
+		names       []string
+		pattern     string
+		wantKept    []string
+		wantSkipped []string
+	}{
+		{"不忽略", nil, "", dbs, nil},
+		{"精确库名", []string{"test", " scratch ", ""}, "", []string{"app_1", "app_2", "test_tmp"}, []string{"scratch", "test"}},
+		{"正则", nil, "^test", []string{"app_1", "app_2", "scratch"}, []string{"test", "test_tmp"}},
+		{"库名和正则同时生效", []string{"scratch"}, "_2$", []string{"app_1", "test", "test_tmp"}, []string{"app_2", "scratch"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newDBIgnoreFilter(tt.names, tt.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			kept, skipped := f.filter(dbs)
+			if !reflect.DeepEqual(kept, tt.wantKept) || !reflect.DeepEqual(skipped, tt.wantSkipped) {
+				t.Errorf("filter() = %v, %v; want %v, %v", kept, skipped, tt.wantKept, tt.wantSkipped)
+			}
+		})
+	}
+
+	if _, err := newDBIgnoreFilter(nil, "("); err == nil {
+		t.Error("无效的 ignore_dbs_regex 应报错")
+	}
+}
+
+func TestListMatchedDatabasesIgnoreDBs(t *testing.T) {
+	pool := newFakePool(t, &fakeDB{query: schemataQuery([]string{"app_1", "app_2", "scratch", "test", "test_tmp"})}, nil)
+	tests := []struct {
+		name     string
+		patterns []string
+		names    []string
+		pattern  string
+		want     string
+	}{
+		{"dbs=% 排除测试库", []string{"%"}, []string{"test", "scratch"}, "", "app_1\napp_2\ntest_tmp"},
+		{"精确库名加正则", []string{"%"}, []string{"scratch"}, "^test", "app_1\napp_2"},
+		{"忽略的库不在匹配结果中", []string{"app_%"}, []string{"test"}, "", "app_1\napp_2"},
+		{"全部被忽略", []string{"test%"}, nil, "^test", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := newDBIgnoreFilter(tt.names, tt.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := &DBDataDiff{}
+			got, verdict := d.listMatchedDatabases(ini.Empty().Section("diff"), pool, tt.patterns, nil, nil, filter)
+			if got != tt.want || verdict.Errors != 0 {
+				t.Errorf("listMatchedDatabases() = %q (errors=%d), want %q", got, verdict.Errors, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithMetaRetry(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxRetries   int
+		failures     int // 前几次尝试失败
+		wantErr      bool
+		wantAttempts int
+	}{
+		{"首次成功", 2, 0, false, 1},
+		{"失败一次后重试成功", 1, 1, false, 2},
+		{"max_retries=0 不重试", 0, 1, true, 1},
+		{"重试次数用尽", 1, 2, true, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := newFakePool(t, &fakeDB{}, nil)
+			d := &DBDataDiff{maxRetries: tt.maxRetries}
+			attempts := 0
+			start := time.Now()
+			err := d.withMetaRetry(pool, "测试查询", func(ctx context.Context, conn *sql.Conn) error {
+				attempts++
+				if attempts <= tt.failures {
+					return errors.New("transient")
+				}
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("withMetaRetry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", attempts, tt.wantAttempts)
+			}
+			// 线性退避：第 n 次重试前等待 n 秒
+			var wantWait time.Duration
+			for i := 1; i < tt.wantAttempts; i++ {
+				wantWait += time.Duration(i) * time.Second
+			}
+			if elapsed := time.Since(start); elapsed < wantWait {
+				t.Errorf("elapsed = %v, want at least %v", elapsed, wantWait)
+			}
+		})
+	}
+}
+
+func TestWithMetaRetryStrict(t *testing.T) {
+	pool := newFakePool(t, &fakeDB{}, nil)
+	failing := func(ctx context.Context, conn *sql.Conn) error { return errors.New("boom") }
+
+	// retryMeta 失败时不中止运行，withMetaRetry 在 strict 模式下中止
+	d := &DBDataDiff{strict: true}
+	if err := d.retryMeta(pool, "测试查询", failing); err == nil || d.aborted() {
+		t.Fatalf("retryMeta() error = %v, aborted = %v; want error without abort", err, d.aborted())
+	}
+	if err := d.withMetaRetry(pool, "测试查询", failing); err == nil || !d.aborted() {
+		t.Fatalf("withMetaRetry() error = %v, aborted = %v; want error and abort", err, d.aborted())
+	}
+}
+
+func TestGetDBListTransientFailure(t *testing.T) {
+	names := schemataQuery([]string{"app_1", "app_2", "other"})
+	calls := 0
+	f := &fakeDB{query: func(conn int, query string, args []driver.NamedValue) (*fakeRows, error) {
+		calls++
+		if calls == 1 {
+			return nil, errors.New("connection reset by peer")
+		}
+		return names(conn, query, args)
+	}}
+	pool := newFakePool(t, f, nil)
+	d := &DBDataDiff{maxRetries: 1}
+	got, err := d.getDBList(pool, "app_%")
+	if err != nil {
+		t.Fatalf("getDBList() error = %v", err)
+	}
+	if want := []string{"app_1", "app_2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("getDBList() = %v, want %v", got, want)
+	}
+	if calls != 2 {
+		t.Errorf("queries = %d, want 2", calls)
+	}
+}
+
+func TestParseTablesDuplicates(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    map[string][]string
+		wantErr bool
+	}{
+		{"空", "", map[string][]string{}, false},
+		{"去重并保持顺序", "app.orders, app.users, app.orders", map[string][]string{"app": {"orders", "users"}}, false},
+		{"空白不影响去重", "app.orders,app . orders ,crm.leads", map[string][]string{"app": {"orders"}, "crm": {"leads"}}, false},
+		{"不同库的同名表不是重复", "a.t, b.t", map[string][]string{"a": {"t"}, "b": {"t"}}, false},
+		{"格式错误", "app.orders, orders", nil, true},
+		{"库名为空", ".orders", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTables(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTables(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTables(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadTablesFileDuplicates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tables.txt")
+	content := "# 需要校验的表\napp.orders\napp.users  # 用户表\n\napp.orders\napp . users\ncrm.leads\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readTablesFile(path)
+	if err != nil {
+		t.Fatalf("readTablesFile() error = %v", err)
+	}
+	if want := "app.orders,app.users,crm.leads"; got != want {
+		t.Errorf("readTablesFile() = %q, want %q", got, want)
+	}
+
+	if err := os.WriteFile(path, []byte("app.orders, app.users\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readTablesFile(path); err == nil {
+		t.Error("一行多个表应报错")
+	}
+}
+
+// captureLog 返回 fn 执行期间输出的日志。
+func captureLog(t *testing.T, fn func()) string {
+	t.Helper()
+	var buf bytes.Buffer
+	logger.SetOutput(&buf)
+	defer logger.SetOutput(io.Discard)
+	fn()
+	return buf.String()
+}
+
+func TestProgressLoggerCadence(t *testing.T) {
+	progressRe := regexp.MustCompile(`表统计进度: (\d+)/(\d+) \((\d+)%\)`)
+	tests := []struct {
+		total, steps int
+		wantLines    int
+	}{
+		{1, 1, 1},
+		{3, 3, 3},       // 33%、66%、100%
+		{100, 100, 100}, // 每个百分比一行
+		{250, 250, 101}, // 表多于 100 张时 0%~100% 每个百分比只输出一次
+		{7, 10, 7},      // 多余的 step 不再输出
+		{0, 3, 0},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d_tables", tt.total), func(t *testing.T) {
+			out := captureLog(t, func() {
+				p := newProgressLogger("db", tt.total)
+				for i := 0; i < tt.steps; i++ {
+					p.step()
+				}
+			})
+			matches := progressRe.FindAllStringSubmatch(out, -1)
+			if len(matches) != tt.wantLines {
+				t.Fatalf("progress lines = %d, want %d\n%s", len(matches), tt.wantLines, out)
+			}
+			last := -1
+			for _, m := range matches {
+				pct, _ := strconv.Atoi(m[3])
+				if pct <= last {
+					t.Errorf("percentage not strictly increasing: %d after %d", pct, last)
+				}
+				last = pct
+			}
+			if tt.wantLines > 0 && last != 100 {
+				t.Errorf("last percentage = %d, want 100", last)
+			}
+		})
+	}
+}
+
+func TestOverlappingDBPatternsOrder(t *testing.T) {
+	pool := newFakePool(t, &fakeDB{query: schemataQuery([]string{"app_1", "app_2", "app_log", "log_1", "zeta"})}, nil)
+	want := "app_1\napp_2\napp_log\nlog_1"
+	for _, patterns := range [][]string{
+		{"app_%", "%log%", "log_%"},
+		{"log_%", "%log%", "app_%"},
+		{"%log%", "app_%", "log_%", "app_1"},
+	} {
+		d := &DBDataDiff{}
+		got, verdict := d.listMatchedDatabases(ini.Empty().Section("diff"), pool, patterns, nil, nil, nil)
+		if got != want || verdict.Errors != 0 {
+			t.Errorf("patterns %v: listMatchedDatabases() = %q (errors=%d), want %q", patterns, got, verdict.Errors, want)
+		}
+	}
+
+	// resolveDBPatterns 本身按首次出现去重，排序由调用方统一完成
+	d := &DBDataDiff{}
+	got, err := d.resolveDBPatterns(pool, "源库", []string{"log_%", "%log%", " ", "app_%"}, regexp.MustCompile("^z"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"log_1", "app_log", "app_1", "app_2", "zeta"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("resolveDBPatterns() = %v, want %v", got, want)
+	}
+}
+
+// tablesQuery 模拟 information_schema.tables 和 SCHEMATA 查询：tables 为库名 -> 表名，库名存在即视为库存在。
+func tablesQuery(tables map[string][]string) func(int, string, []driver.NamedValue) (*fakeRows, error) {
+	return func(_ int, query string, args []driver.NamedValue) (*fakeRows, error) {
+		db := args[0].Value.(string)
+		list, exists := tables[db]
+		switch {
+		case strings.Contains(query, "information_schema.tables"):
+			rows := &fakeRows{cols: []string{"table_name"}}
+			for _, t := range list {
+				rows.rows = append(rows.rows, []driver.Value{t})
+			}
+			return rows, nil
+		case strings.Contains(query, "COUNT(*) FROM INFORMATION_SCHEMA.SCHEMATA"):
+			n := int64(0)
+			if exists {
+				n = 1
+			}
+			return &fakeRows{cols: []string{"n"}, rows: [][]driver.Value{{n}}}, nil
+		}
+		return nil, errors.New("unexpected query: " + query)
+	}
+}
+
+func TestCheckSingleDBEmpty(t *testing.T) {
+	tests := []struct {
+		name         string
+		src, dst     []string
+		ignore       []string
+		reportSkip   bool
+		wantEmpty    bool
+		wantStatuses []string
+		wantTables   int
+	}{
+		{"两侧都没有表", nil, nil, nil, false, true, []string{statusDBEmpty}, 0},
+		{"表全部被忽略不是空库", []string{"tmp_log"}, []string{"tmp_log"}, []string{"tmp_log"}, false, false, nil, 0},
+		{"表全部被忽略并输出 SKIPPED", []string{"tmp_log"}, []string{"tmp_log"}, []string{"tmp_log"}, true, false, []string{statusSkipped}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srcPool := newFakePool(t, &fakeDB{query: tablesQuery(map[string][]string{"app": tt.src})}, nil)
+			dstPool := newFakePool(t, &fakeDB{query: tablesQuery(map[string][]string{"app": tt.dst})}, nil)
+			d := &DBDataDiff{reportSkipped: tt.reportSkip}
+			result := d.checkSingleDB("app", srcPool, dstPool, tt.ignore, 0, false, 1, nil)
+			if result.Empty != tt.wantEmpty || len(result.ErrList) != 0 {
+				t.Fatalf("checkSingleDB() Empty = %v, ErrList = %v; want Empty = %v without errors", result.Empty, result.ErrList, tt.wantEmpty)
+			}
+			var statuses []string
+			for _, row := range result.RowsForCSV {
+				statuses = append(statuses, row[csvColStatus])
+			}
+			if !reflect.DeepEqual(statuses, tt.wantStatuses) {
+				t.Errorf("statuses = %v, want %v", statuses, tt.wantStatuses)
+			}
+
+			// 空库行不计入表数、错误和匹配率
+			v := newRunVerdict([]string{"app"}, result.RowsForCSV, map[string][]string{"app": result.ErrList})
+			if v.Tables != tt.wantTables || !v.passed() || v.exitCode(false) != 0 {
+				t.Errorf("verdict = %+v, want %d tables and passed", v, tt.wantTables)
+			}
+			if matched, compared := countMatched(result.RowsForCSV); matched != 0 || compared != 0 {
+				t.Errorf("countMatched() = %d/%d, want 0/0", matched, compared)
+			}
+		})
+	}
+}
+
+func TestRemoveIgnoredTables(t *testing.T) {
+	d := &DBDataDiff{}
+	tests := []struct {
+		tables, ignore, want []string
+	}{
+		{[]string{"a", "b", "c"}, nil, []string{"a", "b", "c"}},
+		{[]string{"a", "b", "c"}, []string{"b", "x"}, []string{"a", "c"}},
+		{[]string{"a"}, []string{"a"}, []string{}},
+	}
+	for _, tt := range tests {
+		if got := d.removeIgnoredTables(tt.tables, tt.ignore); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("removeIgnoredTables(%v, %v) = %v, want %v", tt.tables, tt.ignore, got, tt.want)
+		}
+	}
+}
+
+func TestRunVerdict(t *testing.T) {
+	row := func(db, table, status string) []string {
+		return []string{db, table, "1", "1", "0", "", status}
+	}
+	tests := []struct {
+		name        string
+		rows        [][]string
+		errTls      map[string][]string
+		want        runVerdict
+		wantPartial bool
+		wantExit    int // allow_partial_success=false
+		wantExitAP  int // allow_partial_success=true
+	}{
+		{"全部一致", [][]string{row("a", "t1", statusOK), row("a", "t2", statusNoGrowth), row("a", "t3", statusBothEmpty)},
+			nil, runVerdict{Tables: 3}, false, 0, 0},
+		{"跳过和删除不算失败", [][]string{row("a", "t1", statusOK), row("a", "t2", statusSkipped), row("a", "t3", statusDropped), row("a", "t4", statusExtra)},
+			nil, runVerdict{Tables: 4}, false, 0, 0},
+		{"不一致", [][]string{row("a", "t1", statusDiff), row("a", "t2", statusSrcMissing), row("a", "t3", statusDstMissing), row("a", "t4", statusDstEmpty)},
+			nil, runVerdict{Tables: 4, Mismatches: 4}, false, 2, 2},
+		{"部分完成", [][]string{row("a", "t1", statusOK), row("a", "t2", statusError), row("a", "t3", statusTimeout)},
+			nil, runVerdict{Tables: 3, Errors: 2, TableErrors: 2}, true, 1, exitPartial},
+		{"全部失败不是部分完成", [][]string{row("a", "t1", statusError)},
+			nil, runVerdict{Tables: 1, Errors: 1, TableErrors: 1}, false, 1, 1},
+		{"有不一致时不是部分完成", [][]string{row("a", "t1", statusDiff), row("a", "t2", statusError), row("a", "t3", statusOK)},
+			nil, runVerdict{Tables: 3, Mismatches: 1, Errors: 1, TableErrors: 1}, false, 1, 1},
+		{"库级错误", [][]string{row("a", "t1", statusOK)},
+			map[string][]string{"b": {"获取源库表列表失败"}}, runVerdict{Tables: 1, Errors: 1}, false, 1, 1},
+		{"库级错误使部分完成失效", [][]string{row("a", "t1", statusOK), row("a", "t2", statusError)},
+			map[string][]string{"b": {"获取源库表列表失败"}}, runVerdict{Tables: 2, Errors: 2, TableErrors: 1}, false, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newRunVerdict([]string{"a", "b"}, tt.rows, tt.errTls)
+			if v != tt.want {
+				t.Fatalf("newRunVerdict() = %+v, want %+v", v, tt.want)
+			}
+			if v.partial() != tt.wantPartial {
+				t.Errorf("partial() = %v, want %v", v.partial(), tt.wantPartial)
+			}
+			if got := v.exitCode(false); got != tt.wantExit {
+				t.Errorf("exitCode(false) = %d, want %d", got, tt.wantExit)
+			}
+			if got := v.exitCode(true); got != tt.wantExitAP {
+				t.Errorf("exitCode(true) = %d, want %d", got, tt.wantExitAP)
+			}
+		})
+	}
+}
+
+func TestStatusClassification(t *testing.T) {
+	tests := []struct {
+		code                      string
+		failure, skipped, matched bool
+	}{
+		{statusOK, false, false, true},
+		{statusDBEmpty, false, false, false},
+		{statusNoGrowth, false, false, true},
+		{statusDiff, true, false, false},
+		{statusSrcMissing, true, false, false},
+		{statusDstMissing, true, false, false},
+		{statusDstEmpty, true, false, false},
+		{statusBothEmpty, false, false, false},
+		{statusError, true, false, false},
+		{statusTimeout, true, false, false},
+		{statusDropped, false, true, false},
+		{statusExtra, false, true, false},
+		{statusSkipped, false, true, false},
+	}
+	if len(tests) != len(allStatusCodes) {
+		t.Fatalf("%d status codes covered, want %d", len(tests), len(allStatusCodes))
+	}
+	for _, tt := range tests {
+		if got := isFailureStatus(tt.code); got != tt.failure {
+			t.Errorf("isFailureStatus(%s) = %v, want %v", tt.code, got, tt.failure)
+		}
+		if got := isSkippedStatus(tt.code); got != tt.skipped {
+			t.Errorf("isSkippedStatus(%s) = %v, want %v", tt.code, got, tt.skipped)
+		}
+		if got := isMatchedStatus(tt.code); got != tt.matched {
+			t.Errorf("isMatchedStatus(%s) = %v, want %v", tt.code, got, tt.matched)
+		}
+	}
+}
+
+func TestCountSnapshotLostOnReconnect(t *testing.T) {
+	var mu sync.Mutex
+	sets := 0
+	f := &fakeDB{
+		query: func(int, string, []driver.NamedValue) (*fakeRows, error) {
+			// COUNT 失败后连接被丢弃，重试时重建连接
+			return nil, errors.New("invalid connection")
+		},
+		exec: func(_ int, query string, _ []driver.NamedValue) error {
+			if !strings.Contains(query, "tidb_snapshot") {
+				return nil
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			sets++
+			if sets > 1 {
+				return errors.New("can not set tidb_snapshot")
+			}
+			return nil
+		},
+	}
+	snapshotTS := "449000000000000000"
+	pool := newFakePool(t, f, &snapshotTS)
+	d := &DBDataDiff{maxRetries: 1}
+
+	counts, _, errList := d.countTableRowsConcurrent(pool, "app", []string{"orders"}, 1)
+	if len(counts) != 0 || len(errList) != 1 {
+		t.Fatalf("countTableRowsConcurrent() = %v, %v; want one error", counts, errList)
+	}
+	var snapErr *tableSnapshotError
+	if !errors.As(errList[0], &snapErr) || snapErr.table != "orders" {
+		t.Fatalf("error = %v (%T), want *tableSnapshotError for orders", errList[0], errList[0])
+	}
+	if sets != 2 {
+		t.Errorf("SET @@tidb_snapshot executed %d times, want 2", sets)
+	}
+	// 快照设置失败单独报告，但不等同于快照早于 GC safe point，不中止整次校验
+	if d.aborted() {
+		t.Errorf("aborted() = true, want false")
+	}
+}
+
+func TestIsSnapshotTooOldError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"9006", &mysql.MySQLError{Number: mysqlErrGCTooEarly, Message: "GC life time is shorter than transaction duration"}, true},
+		{"包装后的 9006", fmt.Errorf("表 t 统计失败: %w", &mysql.MySQLError{Number: mysqlErrGCTooEarly}), true},
+		{"GC safe point 文本", errors.New("snapshot is older than GC safe point `2026-10-16 00:00:00`"), true},
+		{"GC life time 文本", errors.New("GC life time is shorter than transaction duration"), true},
+		{"表不存在", &mysql.MySQLError{Number: mysqlErrNoSuchTable, Message: "Table 'app.t' doesn't exist"}, false},
+		{"其他错误", errors.New("invalid connection"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isSnapshotTooOldError(tt.err); got != tt.want {
+				t.Errorf("isSnapshotTooOldError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCountSnapshotTooOldAborts(t *testing.T) {
+	var mu sync.Mutex
+	counts := 0
+	f := &fakeDB{
+		query: func(_ int, query string, _ []driver.NamedValue) (*fakeRows, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if strings.Contains(query, "COUNT(1)") {
+				counts++
+			}
+			return nil, &mysql.MySQLError{Number: mysqlErrGCTooEarly, Message: "GC life time is shorter than transaction duration"}
+		},
+	}
+	pool := newFakePool(t, f, nil)
+	d := &DBDataDiff{maxRetries: 3}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	defer d.cancel()
+
+	start := time.Now()
+	result, _, errList := d.countTableRowsConcurrent(pool, "app", []string{"orders", "users"}, 1)
+	if len(result) != 0 || len(errList) == 0 {
+		t.Fatalf("countTableRowsConcurrent() = %v, %v; want errors", result, errList)
+	}
+	if !d.aborted() {
+		t.Errorf("aborted() = false, want true")
+	}
+	// 快照早于 GC safe point 时不重试，剩余的表也不再查询
+	if counts != 1 {
+		t.Errorf("COUNT executed %d times, want 1", counts)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("countTableRowsConcurrent() took %v, want no retry backoff", elapsed)
+	}
+}
+
+// pkQuery 模拟按 col 查询主键范围和分段校验和，chunks 为分段值到 {行数, 校验和} 的映射；查询其他列时报错。
+func pkQuery(col string, min, max int64, chunks map[string][2]int64) func(int, string, []driver.NamedValue) (*fakeRows, error) {
+	return func(_ int, query string, _ []driver.NamedValue) (*fakeRows, error) {
+		switch {
+		case strings.Contains(query, "MIN(`"+col+"`)"):
+			return &fakeRows{cols: []string{"min", "max"}, rows: [][]driver.Value{{min, max}}}, nil
+		case strings.Contains(query, "CRC32(`"+col+"`)"):
+			rows := &fakeRows{cols: []string{"chunk", "cnt", "checksum"}}
+			for k, v := range chunks {
+				rows.rows = append(rows.rows, []driver.Value{k, v[0], v[1]})
+			}
+			return rows, nil
+		}
+		return nil, errors.New("unexpected query: " + query)
+	}
+}
+
+func TestCheckPKRanges(t *testing.T) {
+	src := map[string][2]int64{"0": {4, 111}, "1": {5, 222}, "2": {1, 333}}
+	tests := []struct {
+		name       string
+		dstMax     int64
+		dstChunks  map[string][2]int64
+		wantRange  bool
+		wantChunks []string
+	}{
+		{"一致", 10, src, false, nil},
+		{"分段校验和不同", 10, map[string][2]int64{"0": {4, 111}, "1": {5, 999}, "2": {1, 333}}, false, []string{"1"}},
+		{"目标库缺少尾部分段", 9, map[string][2]int64{"0": {4, 111}, "1": {5, 222}}, true, []string{"2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 两侧主键列名不同：源库 id，目标库 order_id
+			srcPool := newFakePool(t, &fakeDB{query: pkQuery("id", 1, 10, src)}, nil)
+			dstPool := newFakePool(t, &fakeDB{query: pkQuery("order_id", 1, tt.dstMax, tt.dstChunks)}, nil)
+			d := &DBDataDiff{pkColumns: map[string][2]string{"app.orders": {"id", "order_id"}}, pkChunkSize: 5}
+			ret := map[string]int64{"orders": 10, "users": 3}
+			mismatched, errs := d.checkPKRanges("app", srcPool, dstPool, ret, ret, 1)
+			if len(errs) != 0 {
+				t.Fatalf("checkPKRanges() errs = %v", errs)
+			}
+			diff, ok := mismatched["orders"]
+			if ok != (tt.wantRange || len(tt.wantChunks) > 0) || diff.Range != tt.wantRange || !reflect.DeepEqual(diff.Chunks, tt.wantChunks) {
+				t.Errorf("checkPKRanges() = %+v, want Range = %v, Chunks = %v", mismatched, tt.wantRange, tt.wantChunks)
+			}
+			if _, ok := mismatched["users"]; ok {
+				t.Errorf("users 未配置 pk_column，不应参与对比")
+			}
+		})
+	}
+}
+
+func TestAsOfMetaReads(t *testing.T) {
+	const tso = "449000000000000000"
+	calls := []struct {
+		name string
+		fn   func(d *DBDataDiff, pool *snapshotConnPool) error
+	}{
+		{"getSchemaObjectCounts", func(d *DBDataDiff, pool *snapshotConnPool) error {
+			_, err := d.getSchemaObjectCounts(pool)
+			return err
+		}},
+		{"getTableAttributes", func(d *DBDataDiff, pool *snapshotConnPool) error {
+			_, err := d.getTableAttributes(pool, []string{"app"})
+			return err
+		}},
+		{"getTableFragmentation", func(d *DBDataDiff, pool *snapshotConnPool) error {
+			_, err := d.getTableFragmentation(pool, []string{"app"})
+			return err
+		}},
+		{"getTiFlashTables", func(d *DBDataDiff, pool *snapshotConnPool) error {
+			_, err := d.getTiFlashTables(pool, "app")
+			return err
+		}},
+		{"getAllocatorStates", func(d *DBDataDiff, pool *snapshotConnPool) error {
+			_, err := d.getAllocatorStates(pool, []string{"app"})
+			return err
+		}},
+		{"getColumnDefs", func(d *DBDataDiff, pool *snapshotConnPool) error {
+			_, err := d.getColumnDefs(pool, "app", "orders")
+			return err
+		}},
+	}
+	for _, c := range calls {
+		t.Run(c.name, func(t *testing.T) {
+			var mu sync.Mutex
+			snapshot := make(map[int]string) // 每个连接当前的 tidb_snapshot
+			var queries, unwrapped int
+			f := &fakeDB{
+				exec: func(conn int, query string, args []driver.NamedValue) error {
+					if !strings.Contains(query, "tidb_snapshot") {
+						return nil
+					}
+					mu.Lock()
+					defer mu.Unlock()
+					snapshot[conn] = ""
+					if len(args) == 1 {
+						snapshot[conn] = fmt.Sprint(args[0].Value)
+					}
+					return nil
+				},
+				query: func(conn int, query string, _ []driver.NamedValue) (*fakeRows, error) {
+					mu.Lock()
+					defer mu.Unlock()
+					if strings.Contains(query, "INFORMATION_SCHEMA") {
+						queries++
+						if snapshot[conn] != tso {
+							unwrapped++
+						}
+					}
+					// 只检查元数据查询是否在快照下执行，不关心结果
+					return nil, errors.New("fake: stop")
+				},
+			}
+			pool := newFakePool(t, f, nil)
+			pool.asOfTSO = tso
+			if err := c.fn(&DBDataDiff{}, pool); err == nil {
+				t.Fatalf("%s() error = nil, want the fake query error", c.name)
+			}
+			if queries == 0 || unwrapped != 0 {
+				t.Errorf("%d of %d INFORMATION_SCHEMA queries ran without tidb_snapshot=%s", unwrapped, queries, tso)
+			}
+			for conn, ts := range snapshot {
+				if ts != "" {
+					t.Errorf("conn %d left with tidb_snapshot=%s, want reset", conn, ts)
+				}
+			}
+		})
+	}
+}
+
+func TestEmptyTablesAlert(t *testing.T) {
+	tests := []struct {
+		name         string
+		alert, fail  bool
+		wantStatus   string
+		wantMatched  int
+		wantMismatch int
+	}{
+		{"默认视为一致", false, false, statusOK, 1, 0},
+		{"alert_empty_tables 告警但不计为一致", true, false, statusBothEmpty, 0, 0},
+		{"fail_on_empty_tables 判定为不一致", true, true, statusDiff, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listTables := tablesQuery(map[string][]string{"app": {"orders"}})
+			query := func(conn int, query string, args []driver.NamedValue) (*fakeRows, error) {
+				if strings.Contains(query, "COUNT(1)") {
+					return &fakeRows{cols: []string{"cnt"}, rows: [][]driver.Value{{int64(0)}}}, nil
+				}
+				return listTables(conn, query, args)
+			}
+			srcPool := newFakePool(t, &fakeDB{query: query}, nil)
+			dstPool := newFakePool(t, &fakeDB{query: query}, nil)
+			d := &DBDataDiff{alertEmptyTables: tt.alert, failOnEmptyTables: tt.fail}
+			result := d.checkSingleDB("app", srcPool, dstPool, nil, 0, false, 1, nil)
+			if len(result.RowsForCSV) != 1 || result.RowsForCSV[0][csvColStatus] != tt.wantStatus {
+				t.Fatalf("checkSingleDB() rows = %v, want one %s row", result.RowsForCSV, tt.wantStatus)
+			}
+			if matched, compared := countMatched(result.RowsForCSV); matched != tt.wantMatched || compared != 1 {
+				t.Errorf("countMatched() = %d/%d, want %d/1", matched, compared, tt.wantMatched)
+			}
+			if v := newRunVerdict([]string{"app"}, result.RowsForCSV, map[string][]string{"app": result.ErrList}); v.Mismatches != tt.wantMismatch {
+				t.Errorf("verdict = %+v, want %d mismatches", v, tt.wantMismatch)
+			}
+		})
+	}
+}
+
+func TestDBEmptyRow(t *testing.T) {
+	dbRow := emptyDBRow("empty_db")
+	if !isDBRow(dbRow) || dbRow[csvColStatus] != statusDBEmpty {
+		t.Fatalf("emptyDBRow() = %v, want a DB_EMPTY DB-level row", dbRow)
+	}
+	tableRow := []string{"app", "orders", "0", "0", "0", "两侧均为空表，请确认数据是否已导入", statusBothEmpty}
+	if isDBRow(tableRow) {
+		t.Errorf("isDBRow(%v) = true, want false", tableRow)
+	}
+	// source_csv 的行可能只有 数据库,表名,源库条数 三列
+	if isDBRow([]string{"app", "orders", "10"}) || !isDBRow([]string{"app", "", "0"}) {
+		t.Errorf("isDBRow() misclassified a short source_csv record")
+	}
+
+	// 空库行不改变对比范围，运行签名不变
+	rows := [][]string{tableRow}
+	base := runSignature([]string{"app", "empty_db"}, rows, 0, "", "", "count", []string{"rows"})
+	if got := runSignature([]string{"app", "empty_db"}, append(rows, dbRow), 0, "", "", "count", []string{"rows"}); got != base {
+		t.Errorf("runSignature() with DB_EMPTY row = %s, want %s", got, base)
+	}
+}
+
+func TestIndexSkipReason(t *testing.T) {
+	counts := func(source string) *SchemaObjectCounts {
+		return &SchemaObjectCounts{IndexSource: source}
+	}
+	tests := []struct {
+		name     string
+		src, dst string
+		baseline bool
+		wantSkip bool
+	}{
+		{"两侧都是 TiDB", indexSourceTiDB, indexSourceTiDB, false, false},
+		{"两侧都是 MySQL", indexSourceStatistics, indexSourceStatistics, false, false},
+		{"TiDB 到 MySQL", indexSourceTiDB, indexSourceStatistics, false, true},
+		{"源库统计失败", "", indexSourceTiDB, false, true},
+		{"目标库统计失败", indexSourceTiDB, "", false, true},
+		{"旧版本基线没有口径", "", indexSourceTiDB, true, false},
+		{"基线口径不同", indexSourceStatistics, indexSourceTiDB, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := indexSkipReason(counts(tt.src), counts(tt.dst), tt.baseline); (got != "") != tt.wantSkip {
+				t.Errorf("indexSkipReason() = %q, want skip = %v", got, tt.wantSkip)
+			}
+		})
+	}
+}
+
+func TestSchemaObjectCountsIndexSource(t *testing.T) {
+	f := &fakeDB{query: func(_ int, query string, _ []driver.NamedValue) (*fakeRows, error) {
+		switch {
+		case strings.Contains(query, "TIDB_INDEXES"):
+			return nil, errors.New("Unknown table 'TIDB_INDEXES' in information_schema")
+		case strings.Contains(query, "STATISTICS"):
+			return &fakeRows{cols: []string{"schema", "sum"}, rows: [][]driver.Value{{"app", int64(3)}}}, nil
+		}
+		return &fakeRows{cols: []string{"schema", "sum"}}, nil
+	}}
+	pool := newFakePool(t, f, nil)
+	counts, err := (&DBDataDiff{}).getSchemaObjectCounts(pool)
+	if err != nil {
+		t.Fatalf("getSchemaObjectCounts() error = %v", err)
+	}
+	if counts.IndexSource != indexSourceStatistics || counts.Indexes["app"] != 3 {
+		t.Errorf("IndexSource = %q, Indexes = %v; want STATISTICS with app=3", counts.IndexSource, counts.Indexes)
+	}
+}
+
+func TestCheckNonzeroDstDBErrList(t *testing.T) {
+	listTables := tablesQuery(map[string][]string{"app": {"empty_t", "broken_t", "ok_t"}})
+	query := func(conn int, query string, args []driver.NamedValue) (*fakeRows, error) {
+		switch {
+		case strings.Contains(query, "`empty_t`"):
+			return &fakeRows{cols: []string{"cnt"}, rows: [][]driver.Value{{int64(0)}}}, nil
+		case strings.Contains(query, "`broken_t`"):
+			return nil, errors.New("region unavailable")
+		case strings.Contains(query, "`ok_t`"):
+			return &fakeRows{cols: []string{"cnt"}, rows: [][]driver.Value{{int64(5)}}}, nil
+		}
+		return listTables(conn, query, args)
+	}
+	dstPool := newFakePool(t, &fakeDB{query: query}, nil)
+	result := (&DBDataDiff{}).checkNonzeroDstDB("app", dstPool, nil, 1, nil)
+	// 与 checkSingleDB 相同：不一致的表记表名，统计失败记错误信息
+	if len(result.ErrList) != 2 || result.ErrList[1] != "empty_t" || !strings.Contains(result.ErrList[0], "broken_t") || !strings.Contains(result.ErrList[0], "region unavailable") {
+		t.Errorf("ErrList = %q, want the broken_t error message and empty_t", result.ErrList)
+	}
+}
+
+func TestFormatThousands(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0"},
+		{999, "999"},
+		{1000, "1,000"},
+		{123456789, "123,456,789"},
+		{-1, "-1"},
+		{-1234, "-1,234"},
+		{-123456, "-123,456"},
+		{math.MaxInt64, "9,223,372,036,854,775,807"},
+		{math.MinInt64, "-9,223,372,036,854,775,808"},
+	}
+	for _, tt := range tests {
+		if got := formatThousands(tt.n); got != tt.want {
+			t.Errorf("formatThousands(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}